@@ -2,7 +2,118 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/postbasho/influxdb-comparisons/predicate"
+)
+
+// AggregationKind enumerates the aggregate functions this module knows how
+// to translate into Riak TS queries, mirroring the set InfluxDB's
+// AggregateExecutor supports.
+type AggregationKind int
+
+const (
+	AggregationCount AggregationKind = iota
+	AggregationSum
+	AggregationMean
+	AggregationMin
+	AggregationMax
+	AggregationStddev
+	AggregationFirst
+	AggregationLast
+	AggregationPercentile
+)
+
+// Aggregation describes a single aggregate function requested by an
+// HLQuery. Percentile is only meaningful when Kind is
+// AggregationPercentile.
+type Aggregation struct {
+	Kind       AggregationKind
+	Label      string // the original label, e.g. "percentile_95"
+	Percentile float64
+}
+
+// ParseAggregation parses an aggregation label as emitted by the bulk query
+// generators (e.g. "avg", "sum", "percentile_95") into an Aggregation.
+func ParseAggregation(label string) (Aggregation, error) {
+	if strings.HasPrefix(label, "percentile_") {
+		pStr := strings.TrimPrefix(label, "percentile_")
+		p, err := strconv.ParseFloat(pStr, 64)
+		if err != nil {
+			return Aggregation{}, fmt.Errorf("invalid percentile aggregation %q: %s", label, err)
+		}
+		if p < 0 || p > 100 {
+			return Aggregation{}, fmt.Errorf("percentile aggregation %q out of range [0, 100]", label)
+		}
+		return Aggregation{Kind: AggregationPercentile, Label: label, Percentile: p}, nil
+	}
+
+	switch label {
+	case "count":
+		return Aggregation{Kind: AggregationCount, Label: label}, nil
+	case "sum":
+		return Aggregation{Kind: AggregationSum, Label: label}, nil
+	case "mean", "avg":
+		return Aggregation{Kind: AggregationMean, Label: label}, nil
+	case "min":
+		return Aggregation{Kind: AggregationMin, Label: label}, nil
+	case "max":
+		return Aggregation{Kind: AggregationMax, Label: label}, nil
+	case "stddev":
+		return Aggregation{Kind: AggregationStddev, Label: label}, nil
+	case "first":
+		return Aggregation{Kind: AggregationFirst, Label: label}, nil
+	case "last":
+		return Aggregation{Kind: AggregationLast, Label: label}, nil
+	default:
+		return Aggregation{}, fmt.Errorf("unknown aggregation type %q", label)
+	}
+}
+
+// ServerAggregatable reports whether Riak TS can compute this aggregation
+// natively in a single SQL query. count/sum/mean/min/max map directly onto
+// Riak TS SQL aggregate functions; stddev/first/last/percentile do not and
+// must instead be reduced client-side over the raw values.
+func (a Aggregation) ServerAggregatable() bool {
+	switch a.Kind {
+	case AggregationCount, AggregationSum, AggregationMean, AggregationMin, AggregationMax:
+		return true
+	default:
+		return false
+	}
+}
+
+// riakTSFunc returns the Riak TS SQL aggregate function name for
+// server-aggregatable Aggregations. It must not be called otherwise.
+func (a Aggregation) riakTSFunc() string {
+	switch a.Kind {
+	case AggregationCount:
+		return "count"
+	case AggregationSum:
+		return "sum"
+	case AggregationMean:
+		return "avg"
+	case AggregationMin:
+		return "min"
+	case AggregationMax:
+		return "max"
+	default:
+		panic(fmt.Sprintf("riakTSFunc called on non-server-aggregatable Aggregation %+v", a))
+	}
+}
+
+// FillMode controls how a QueryPlan renders a 'group by time' bucket for
+// which no points matched, mirroring InfluxDB's `fill()` query clause.
+type FillMode string
+
+const (
+	FillNone     FillMode = "none"     // omit empty buckets entirely
+	FillNull     FillMode = "null"     // render empty buckets with a null value
+	FillPrevious FillMode = "previous" // carry the previous non-empty bucket's value forward
+	// Any other value is parsed as a numeric constant to fill empty buckets
+	// with, or "linear" to interpolate between the surrounding buckets.
 )
 
 // HLQuery is a high-level query, usually read from stdin after being
@@ -22,6 +133,15 @@ type HLQuery struct {
 	TimeEnd         time.Time
 	GroupByDuration time.Duration
 	TagSets         [][]string // semantically, each subgroup is OR'ed and they are all AND'ed together
+	FillMode        FillMode   // how to render empty 'group by time' buckets; defaults to FillNull
+
+	// SpaceAggregation, when non-empty (e.g. "avg"), requests a second
+	// aggregation stage that combines the per-series, per-bucket results
+	// named by AggregationType across all matching series in the same
+	// bucket, e.g. "avg CPU across all hosts, bucketed 1m". Only
+	// ToQueryPlanWithServerAggregation applies it. When it is empty, a plan
+	// whose bucket holds more than one series returns an error from Execute.
+	SpaceAggregation []byte
 }
 
 // String produces a debug-ready description of a Query.
@@ -35,9 +155,44 @@ func (q *HLQuery) ForceUTC() {
 	q.TimeEnd = q.TimeEnd.UTC()
 }
 
+// NewHLQueryFromPredicate builds an HLQuery's time range, group-by
+// duration, and tag sets by lowering an InfluxQL-flavored predicate string
+// (see package predicate), e.g.
+//
+//	time >= '2016-01-01T00:00:00Z' AND time < '2016-01-02T00:00:00Z' AND (host = 'a' OR host = 'b') GROUP BY time(1m)
+//
+// The caller is still responsible for setting MeasurementName, FieldName,
+// and AggregationType.
+func NewHLQueryFromPredicate(pred string, now time.Time) (*HLQuery, error) {
+	r, err := predicate.Parse(pred, now)
+	if err != nil {
+		return nil, err
+	}
+	return &HLQuery{
+		TimeStart:       r.TimeStart,
+		TimeEnd:         r.TimeEnd,
+		GroupByDuration: r.GroupByDuration,
+		TagSets:         r.TagSets,
+	}, nil
+}
+
 // ToQueryPlanWithServerAggregation combines an HLQuery with a
 // ClientSideIndex to make a QueryPlanWithServerAggregation.
 func (q *HLQuery) ToQueryPlanWithServerAggregation(csi *ClientSideIndex) (qp *QueryPlanWithServerAggregation, err error) {
+	agg, err := ParseAggregation(string(q.AggregationType))
+	if err != nil {
+		return nil, err
+	}
+
+	var spaceAgg *SpaceAggregationKind
+	if len(q.SpaceAggregation) > 0 {
+		k, err := ParseSpaceAggregation(string(q.SpaceAggregation))
+		if err != nil {
+			return nil, err
+		}
+		spaceAgg = &k
+	}
+
 	seriesChoices := csi.SeriesForMeasurementAndField(string(q.MeasurementName), string(q.FieldName))
 
 	// Build the time buckets used for 'group by time'-type queries.
@@ -78,24 +233,28 @@ func (q *HLQuery) ToQueryPlanWithServerAggregation(csi *ClientSideIndex) (qp *Qu
 	for ti, seriesSlice := range bucketedSeries {
 		riakTSQueries := make([]RiakTSQuery, len(seriesSlice))
 		for i, ser := range seriesSlice {
-			start := ti.Start
-			end := ti.End
-
-			// the following two special cases ensure equivalency with rounded time boundaries as seen in influxdb:
-			// https://docs.influxdata.com/influxdb/v0.13/query_language/data_exploration/#rounded-group-by-time-boundaries
-			if start.Before(q.TimeStart) {
-				start = q.TimeStart
-			}
-			if end.After(q.TimeEnd) {
-				end = q.TimeEnd
-			}
+			start, end := clampToQueryBounds(ti.Start, ti.End, q.TimeStart, q.TimeEnd)
 
-			riakTSQueries[i] = NewRiakTSQuery(string(q.AggregationType), ser.Table, ser.Id, start.UnixNano(), end.UnixNano())
+			riakTSQueries[i] = NewRiakTSQuery(agg, ser.Table, ser.Id, start.UnixNano(), end.UnixNano())
 		}
 		riakTSBuckets[ti] = riakTSQueries
 	}
 
-	qp, err = NewQueryPlanWithServerAggregation(string(q.AggregationType), riakTSBuckets)
+	fillMode := q.FillMode
+	if fillMode == "" {
+		fillMode = FillNull
+	}
+
+	// Riak TS cannot natively compute stddev/first/last/percentile, so those
+	// are reduced client-side from the raw values fetched above instead of
+	// from a server-computed aggregate.
+	//
+	// When spaceAgg is set, the plan's Execute path runs a second reducer
+	// stage after the per-series temporal aggregation above: it groups the
+	// per-series bucket results by TimeInterval and combines them with
+	// ReduceBucketsBySpace, so e.g. "avg CPU across all hosts" can be
+	// computed from per-host "avg CPU per bucket" results.
+	qp, err = NewQueryPlanWithServerAggregation(agg, riakTSBuckets, spaceAgg, fillMode)
 	return
 }
 
@@ -104,6 +263,11 @@ func (q *HLQuery) ToQueryPlanWithServerAggregation(csi *ClientSideIndex) (qp *Qu
 //
 // It executes at most one RiakTSQuery per series.
 func (q *HLQuery) ToQueryPlanWithoutServerAggregation(csi *ClientSideIndex) (qp *QueryPlanWithoutServerAggregation, err error) {
+	agg, err := ParseAggregation(string(q.AggregationType))
+	if err != nil {
+		return nil, err
+	}
+
 	hlQueryInterval := NewTimeInterval(q.TimeStart, q.TimeEnd)
 	seriesChoices := csi.SeriesForMeasurementAndField(string(q.MeasurementName), string(q.FieldName))
 
@@ -133,31 +297,73 @@ func (q *HLQuery) ToQueryPlanWithoutServerAggregation(csi *ClientSideIndex) (qp
 		applicableSeries = append(applicableSeries, s)
 	}
 
-	// Build RiakTSQuery objects that will be used to fulfill this HLQuery:
+	// Build RiakTSQuery objects that will be used to fulfill this HLQuery.
+	// Each one is tagged with a ShardKey derived from its series so the
+	// executor can route it to the right per-node connection pool.
 	riakTSQueries := []RiakTSQuery{}
 	for _, ser := range applicableSeries {
-		q := NewRiakTSQuery("", ser.Table, ser.Id, q.TimeStart.UnixNano(), q.TimeEnd.UnixNano())
-		riakTSQueries = append(riakTSQueries, q)
+		rq := NewRiakTSQuery(Aggregation{}, ser.Table, ser.Id, q.TimeStart.UnixNano(), q.TimeEnd.UnixNano())
+		rq.ShardKey = shardKeyFor(ser.Table, ser.Id)
+		riakTSQueries = append(riakTSQueries, rq)
 	}
 
-	qp, err = NewQueryPlanWithoutServerAggregation(string(q.AggregationType), q.GroupByDuration, timeBuckets, riakTSQueries)
+	fillMode := q.FillMode
+	if fillMode == "" {
+		fillMode = FillNull
+	}
+
+	qp, err = NewQueryPlanWithoutServerAggregation(agg, q.GroupByDuration, timeBuckets, riakTSQueries, fillMode)
 	return
 }
 
+// clampToQueryBounds narrows a time bucket's [start, end) interval to the
+// HLQuery's own [qStart, qEnd] time range. 'group by time' buckets are
+// rounded to the interval (see
+// https://docs.influxdata.com/influxdb/v0.13/query_language/data_exploration/#rounded-group-by-time-boundaries),
+// so the first bucket can start before qStart and the last can end after
+// qEnd; this keeps the RiakTSQuery built from each bucket from asking for
+// data outside the range the caller actually requested. A bucket already
+// inside [qStart, qEnd] is returned unchanged.
+func clampToQueryBounds(start, end, qStart, qEnd time.Time) (time.Time, time.Time) {
+	if start.Before(qStart) {
+		start = qStart
+	}
+	if end.After(qEnd) {
+		end = qEnd
+	}
+	return start, end
+}
+
 type RiakTSQuery struct {
 	QueryString string
+
+	// ShardKey routes this query to a per-node connection pool so that a
+	// QueryPlan can be executed concurrently across shards. It is the zero
+	// value until set explicitly by the caller (see shardKeyFor).
+	ShardKey ShardKey
 }
 
-// NewRiakTSQuery builds a RiakTSQuery
-func NewRiakTSQuery(aggrLabel, tableName, rowName string, timeStartNanos, timeEndNanos int64) RiakTSQuery {
+// NewRiakTSQuery builds a RiakTSQuery for the given Aggregation.
+//
+// When agg is the zero Aggregation, the raw time/value rows are fetched so
+// the caller can reduce them client-side. When agg.ServerAggregatable() is
+// false (stddev/first/last/percentile), the raw rows are likewise fetched
+// unaggregated, since Riak TS has no SQL form for those functions; the
+// caller is responsible for reducing them client-side instead.
+func NewRiakTSQuery(agg Aggregation, tableName, rowName string, timeStartNanos, timeEndNanos int64) RiakTSQuery {
 	var queryString string
 
-	if aggrLabel == "" {
+	switch {
+	case agg.Label == "":
+		queryString = fmt.Sprintf("SELECT time, value FROM usertable WHERE series = '%s' AND time >= %d AND time < %d", rowName, timeStartNanos, timeEndNanos)
+	case agg.ServerAggregatable():
+		queryString = fmt.Sprintf("SELECT %s(value) FROM usertable WHERE series = '%s' AND time >= %d AND time < %d", agg.riakTSFunc(), rowName, timeStartNanos, timeEndNanos)
+	default:
+		// No native Riak TS SQL form exists for this aggregation, so fetch
+		// the raw values and let the query plan reduce them client-side.
 		queryString = fmt.Sprintf("SELECT time, value FROM usertable WHERE series = '%s' AND time >= %d AND time < %d", rowName, timeStartNanos, timeEndNanos)
-	} else {
-		queryString = fmt.Sprintf("SELECT %s(value) FROM usertable WHERE series = '%s' AND time >= %d AND time < %d", aggrLabel, rowName, timeStartNanos, timeEndNanos)
 	}
-	return RiakTSQuery{queryString}
+	return RiakTSQuery{QueryString: queryString}
 }
 
 // Type RiakTSResult holds a result from a set of RiakTS aggregation queries.
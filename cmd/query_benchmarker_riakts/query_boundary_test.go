@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestClampToQueryBoundsExcludesPointsOutsideQueryRange is an end-to-end
+// test driving the real clampToQueryBounds, NewRiakTSQuery, and
+// QueryPlanWithServerAggregation.Execute together. 'group by time' buckets
+// are rounded to the interval (as bucketTimeIntervals would produce for a
+// GROUP BY time() that doesn't evenly divide the query range), so the
+// first bucket here starts before qStart and the last ends after qEnd.
+// clampToQueryBounds narrows the RiakTSQuery built from each bucket back to
+// [qStart, qEnd), so points outside that range but inside a bucket's raw
+// boundaries must not appear in any bucket's result, while a point sampled
+// exactly at qStart or just inside qEnd must still be counted.
+func TestClampToQueryBoundsExcludesPointsOutsideQueryRange(t *testing.T) {
+	qStart := time.Unix(0, 0)
+	qEnd := qStart.Add(3 * time.Minute)
+
+	rawBuckets := []TimeInterval{
+		NewTimeInterval(qStart.Add(-15*time.Second), qStart.Add(time.Minute)),
+		NewTimeInterval(qStart.Add(time.Minute), qStart.Add(2*time.Minute)),
+		NewTimeInterval(qStart.Add(2*time.Minute), qEnd.Add(15*time.Second)),
+	}
+
+	points := []RiakTSRow{
+		{Time: qStart.Add(-10 * time.Second), Value: 100}, // before qStart: must be excluded
+		{Time: qStart, Value: 1},                          // exactly on qStart: must be included
+		{Time: qStart.Add(30 * time.Second), Value: 2},
+		{Time: qStart.Add(90 * time.Second), Value: 3},
+		{Time: qEnd.Add(-time.Second), Value: 4},       // just inside qEnd: must be included
+		{Time: qEnd.Add(10 * time.Second), Value: 200}, // after qEnd: must be excluded
+	}
+
+	cases := []struct {
+		label string
+		kind  AggregationKind
+		want  map[TimeInterval]float64
+	}{
+		{"count", AggregationCount, map[TimeInterval]float64{
+			rawBuckets[0]: 2,
+			rawBuckets[1]: 1,
+			rawBuckets[2]: 1,
+		}},
+		{"sum", AggregationSum, map[TimeInterval]float64{
+			rawBuckets[0]: 3,
+			rawBuckets[1]: 3,
+			rawBuckets[2]: 4,
+		}},
+		{"min", AggregationMin, map[TimeInterval]float64{
+			rawBuckets[0]: 1,
+			rawBuckets[1]: 3,
+			rawBuckets[2]: 4,
+		}},
+		{"max", AggregationMax, map[TimeInterval]float64{
+			rawBuckets[0]: 2,
+			rawBuckets[1]: 3,
+			rawBuckets[2]: 4,
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			agg, err := ParseAggregation(c.label)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			queryBounds := map[RiakTSQuery]TimeInterval{}
+			buckets := map[TimeInterval][]RiakTSQuery{}
+			for _, raw := range rawBuckets {
+				start, end := clampToQueryBounds(raw.Start, raw.End, qStart, qEnd)
+				q := NewRiakTSQuery(agg, "cpu", "host_0", start.UnixNano(), end.UnixNano())
+				buckets[raw] = []RiakTSQuery{q}
+				queryBounds[q] = NewTimeInterval(start, end)
+			}
+
+			// run simulates Riak TS: it only ever sees the clamped
+			// [start, end) embedded in the query, so a point outside
+			// [qStart, qEnd) can only leak into a result if clamping
+			// failed to narrow the bucket that contains it.
+			run := func(q RiakTSQuery) ([]RiakTSRow, error) {
+				bound := queryBounds[q]
+				var matched []float64
+				for _, p := range points {
+					if !p.Time.Before(bound.Start) && p.Time.Before(bound.End) {
+						matched = append(matched, p.Value)
+					}
+				}
+				switch c.kind {
+				case AggregationCount:
+					return []RiakTSRow{{Value: float64(len(matched))}}, nil
+				case AggregationSum:
+					return []RiakTSRow{{Value: sumValues(matched)}}, nil
+				case AggregationMin:
+					return []RiakTSRow{{Value: minValue(matched)}}, nil
+				case AggregationMax:
+					return []RiakTSRow{{Value: maxValue(matched)}}, nil
+				default:
+					t.Fatalf("unhandled aggregation kind in test fixture: %v", c.kind)
+					return nil, nil
+				}
+			}
+
+			plan, err := NewQueryPlanWithServerAggregation(agg, buckets, nil, FillNull)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, err := plan.Execute(run)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, raw := range rawBuckets {
+				if got, want := results[raw], c.want[raw]; got != want {
+					t.Errorf("bucket %v: got %v, want %v", raw, got, want)
+				}
+			}
+		})
+	}
+}
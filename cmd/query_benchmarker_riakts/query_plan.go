@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TimeInterval is a half-open [Start, End) time bucket, as produced by
+// bucketTimeIntervals for a 'group by time' query.
+type TimeInterval struct {
+	Start time.Time
+	End   time.Time
+}
+
+// NewTimeInterval builds a TimeInterval spanning [start, end).
+func NewTimeInterval(start, end time.Time) TimeInterval {
+	return TimeInterval{Start: start, End: end}
+}
+
+// RiakTSRow is a single raw (timestamp, value) row, as returned for an
+// unaggregated RiakTSQuery (one built with the zero Aggregation). A
+// server-aggregated RiakTSQuery instead returns at most one row, whose
+// Value is the aggregate and whose Time is unset; it returns no rows when
+// its range contained no points.
+type RiakTSRow struct {
+	Time  time.Time
+	Value float64
+}
+
+// RiakTSRunner executes a single RiakTSQuery against Riak TS and returns
+// its raw rows.
+type RiakTSRunner func(RiakTSQuery) ([]RiakTSRow, error)
+
+// QueryPlanWithServerAggregation executes one RiakTSQuery per series per
+// 'group by time' bucket, where each query already asks Riak TS to
+// aggregate server-side wherever it can.
+type QueryPlanWithServerAggregation struct {
+	aggregation      Aggregation
+	spaceAggregation *SpaceAggregationKind
+	buckets          map[TimeInterval][]RiakTSQuery
+	fillMode         FillMode
+}
+
+// NewQueryPlanWithServerAggregation builds a QueryPlanWithServerAggregation
+// from the per-bucket RiakTSQueries produced by
+// HLQuery.ToQueryPlanWithServerAggregation.
+func NewQueryPlanWithServerAggregation(agg Aggregation, buckets map[TimeInterval][]RiakTSQuery, spaceAgg *SpaceAggregationKind, fillMode FillMode) (*QueryPlanWithServerAggregation, error) {
+	return &QueryPlanWithServerAggregation{
+		aggregation:      agg,
+		spaceAggregation: spaceAgg,
+		buckets:          buckets,
+		fillMode:         fillMode,
+	}, nil
+}
+
+// Execute runs every RiakTSQuery in the plan via run and reduces each
+// series' rows to a single value per bucket: a passthrough for
+// count/sum/mean/min/max, which Riak TS already aggregated server-side, or
+// a client-side reduction for stddev/first/last/percentile, which it has
+// no SQL form for. Buckets with no series at all, and buckets whose
+// series reduced to NaN (e.g. a server-aggregatable query whose clamped
+// range contained no points), are both rendered per qp.fillMode (see
+// applyFillMode), the same as QueryPlanWithoutServerAggregation.
+func (qp *QueryPlanWithServerAggregation) Execute(run RiakTSRunner) (map[TimeInterval]float64, error) {
+	perSeries, err := executePerSeriesBuckets(qp.buckets, qp.aggregation, run)
+	if err != nil {
+		return nil, err
+	}
+	values, err := collapseToSingleValuePerBucket(perSeries, qp.spaceAggregation)
+	if err != nil {
+		return nil, err
+	}
+	for ti, v := range values {
+		if math.IsNaN(v) {
+			delete(values, ti)
+		}
+	}
+
+	ordered := make([]TimeInterval, 0, len(qp.buckets))
+	for ti := range qp.buckets {
+		ordered = append(ordered, ti)
+	}
+	return applyFillMode(values, ordered, qp.fillMode)
+}
+
+// executePerSeriesBuckets runs every RiakTSQuery in buckets and reduces
+// each one's rows to a single (TimeInterval, value) result.
+func executePerSeriesBuckets(buckets map[TimeInterval][]RiakTSQuery, agg Aggregation, run RiakTSRunner) ([]RiakTSResult, error) {
+	var out []RiakTSResult
+	for ti, queries := range buckets {
+		for _, q := range queries {
+			rows, err := run(q)
+			if err != nil {
+				return nil, fmt.Errorf("executing query %q: %s", q.QueryString, err)
+			}
+
+			v, err := reduceSeriesRows(agg, rows)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, RiakTSResult{TimeInterval: ti, Value: v})
+		}
+	}
+	return out, nil
+}
+
+// reduceSeriesRows reduces a single series' rows to one value for its
+// bucket. count/sum/mean/min/max arrive as a single already-aggregated
+// row, or zero rows if the bucket's (possibly clamped) range contained no
+// points - Riak TS SQL aggregates return an empty result set rather than a
+// null row over an empty range - which is treated as an empty bucket (NaN)
+// for applyFillMode to render. stddev/first/last/percentile arrive as raw
+// rows, since Riak TS has no SQL form for them, and are reduced
+// client-side here instead.
+func reduceSeriesRows(agg Aggregation, rows []RiakTSRow) (float64, error) {
+	if agg.ServerAggregatable() {
+		switch len(rows) {
+		case 0:
+			return math.NaN(), nil
+		case 1:
+			return rows[0].Value, nil
+		default:
+			return 0, fmt.Errorf("expected at most one server-aggregated row for %q, got %d", agg.Label, len(rows))
+		}
+	}
+
+	if len(rows) == 0 {
+		return math.NaN(), nil
+	}
+	return reduceRawRows(agg, rows), nil
+}
+
+// reduceRawRows computes agg entirely client-side over a series' raw
+// rows, sorting them by time first so first/last are well-defined.
+func reduceRawRows(agg Aggregation, rows []RiakTSRow) float64 {
+	sorted := append([]RiakTSRow(nil), rows...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Time.Before(sorted[j].Time) })
+
+	values := make([]float64, len(sorted))
+	for i, r := range sorted {
+		values[i] = r.Value
+	}
+
+	switch agg.Kind {
+	case AggregationCount:
+		return float64(len(values))
+	case AggregationSum:
+		return sumValues(values)
+	case AggregationMean:
+		return sumValues(values) / float64(len(values))
+	case AggregationMin:
+		return minValue(values)
+	case AggregationMax:
+		return maxValue(values)
+	case AggregationStddev:
+		return stddevValues(values)
+	case AggregationFirst:
+		return values[0]
+	case AggregationLast:
+		return values[len(values)-1]
+	case AggregationPercentile:
+		return percentileValue(values, agg.Percentile)
+	default:
+		panic(fmt.Sprintf("reduceRawRows: unhandled aggregation kind %v", agg.Kind))
+	}
+}
+
+func sumValues(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func minValue(values []float64) float64 {
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+func maxValue(values []float64) float64 {
+	max := values[0]
+	for _, v := range values[1:] {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// stddevValues returns the sample standard deviation of values.
+func stddevValues(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	mean := sumValues(values) / float64(len(values))
+
+	var sumSq float64
+	for _, v := range values {
+		d := v - mean
+		sumSq += d * d
+	}
+	return math.Sqrt(sumSq / float64(len(values)-1))
+}
+
+// percentileValue returns the p-th percentile (0-100) of values, linearly
+// interpolating between the closest ranks.
+func percentileValue(values []float64, p float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	if lo == hi {
+		return sorted[lo]
+	}
+	frac := rank - float64(lo)
+	return sorted[lo]*(1-frac) + sorted[hi]*frac
+}
+
+// collapseToSingleValuePerBucket reduces perSeries down to one value per
+// TimeInterval. When spaceAgg is set, more than one series' result in the
+// same bucket is combined with ReduceBucketsBySpace; otherwise more than
+// one series per bucket is an error, since there would be no single value
+// to report.
+func collapseToSingleValuePerBucket(perSeries []RiakTSResult, spaceAgg *SpaceAggregationKind) (map[TimeInterval]float64, error) {
+	if spaceAgg != nil {
+		out := make(map[TimeInterval]float64, len(perSeries))
+		for _, r := range ReduceBucketsBySpace(perSeries, *spaceAgg) {
+			out[r.TimeInterval] = r.Value
+		}
+		return out, nil
+	}
+
+	grouped := map[TimeInterval][]float64{}
+	for _, r := range perSeries {
+		grouped[r.TimeInterval] = append(grouped[r.TimeInterval], r.Value)
+	}
+
+	out := make(map[TimeInterval]float64, len(grouped))
+	for ti, values := range grouped {
+		if len(values) > 1 {
+			return nil, fmt.Errorf("bucket %v has %d series; set HLQuery.SpaceAggregation to combine them", ti, len(values))
+		}
+		out[ti] = values[0]
+	}
+	return out, nil
+}
+
+// QueryPlanWithoutServerAggregation executes at most one unaggregated
+// RiakTSQuery per series and performs every aggregation entirely
+// client-side, bucketing each series' raw rows by TimeInterval before
+// reducing.
+type QueryPlanWithoutServerAggregation struct {
+	aggregation Aggregation
+	groupBy     time.Duration
+	buckets     []TimeInterval
+	queries     []RiakTSQuery
+	fillMode    FillMode
+}
+
+// NewQueryPlanWithoutServerAggregation builds a
+// QueryPlanWithoutServerAggregation from the per-series RiakTSQueries
+// produced by HLQuery.ToQueryPlanWithoutServerAggregation.
+func NewQueryPlanWithoutServerAggregation(agg Aggregation, groupBy time.Duration, buckets []TimeInterval, queries []RiakTSQuery, fillMode FillMode) (*QueryPlanWithoutServerAggregation, error) {
+	return &QueryPlanWithoutServerAggregation{
+		aggregation: agg,
+		groupBy:     groupBy,
+		buckets:     buckets,
+		queries:     queries,
+		fillMode:    fillMode,
+	}, nil
+}
+
+// Execute runs every RiakTSQuery in the plan concurrently via executor,
+// which fans them out across a worker pool and streams each shard's rows
+// back as they complete rather than waiting for every query to finish. It
+// buckets each series' raw rows by TimeInterval and reduces each bucket's
+// values with aggregation; buckets with no data are rendered per fillMode
+// (see applyFillMode). The per-query latencies observed, in completion
+// order, are returned alongside the bucketed values for the benchmark
+// harness to report.
+func (qp *QueryPlanWithoutServerAggregation) Execute(executor *ShardExecutor) (map[TimeInterval]float64, []time.Duration, error) {
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		values    = make(map[TimeInterval]float64, len(qp.buckets))
+		execErr   error
+	)
+
+	executor.Execute(qp.queries, func(res ShardResult) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		latencies = append(latencies, res.Latency)
+		if res.Err != nil {
+			if execErr == nil {
+				execErr = fmt.Errorf("executing query for shard %d: %s", res.ShardKey, res.Err)
+			}
+			return
+		}
+
+		for _, ti := range qp.buckets {
+			var inBucket []RiakTSRow
+			for _, r := range res.Rows {
+				if !r.Time.Before(ti.Start) && r.Time.Before(ti.End) {
+					inBucket = append(inBucket, r)
+				}
+			}
+			if len(inBucket) == 0 {
+				continue
+			}
+			if _, ok := values[ti]; ok {
+				if execErr == nil {
+					execErr = fmt.Errorf("bucket %v has more than one series; this plan does not combine series", ti)
+				}
+				continue
+			}
+			values[ti] = reduceRawRows(qp.aggregation, inBucket)
+		}
+	})
+	if execErr != nil {
+		return nil, nil, execErr
+	}
+
+	filled, err := applyFillMode(values, qp.buckets, qp.fillMode)
+	if err != nil {
+		return nil, nil, err
+	}
+	return filled, latencies, nil
+}
+
+// applyFillMode renders a value for every bucket, including ones with no
+// data, per fillMode, mirroring InfluxDB's fill() clause:
+//
+//   - FillNone: the bucket is omitted from the result entirely.
+//   - FillNull: the bucket maps to NaN.
+//   - FillPrevious: the bucket carries the nearest preceding bucket's
+//     value forward (NaN if none exists).
+//   - "linear": the bucket interpolates between its nearest non-empty
+//     neighbors (NaN if it has none on one side).
+//   - anything else is parsed as a numeric constant to fill the bucket
+//     with.
+func applyFillMode(values map[TimeInterval]float64, buckets []TimeInterval, fillMode FillMode) (map[TimeInterval]float64, error) {
+	if fillMode == "" {
+		fillMode = FillNull
+	}
+
+	ordered := append([]TimeInterval(nil), buckets...)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Start.Before(ordered[j].Start) })
+
+	out := make(map[TimeInterval]float64, len(ordered))
+	for i, ti := range ordered {
+		if v, ok := values[ti]; ok {
+			out[ti] = v
+			continue
+		}
+
+		switch fillMode {
+		case FillNone:
+			continue
+		case FillNull:
+			out[ti] = math.NaN()
+		case FillPrevious:
+			v, _, _ := nearestBefore(ordered, values, i)
+			out[ti] = v
+		case "linear":
+			before, beforeIdx, haveBefore := nearestBefore(ordered, values, i)
+			after, afterIdx, haveAfter := nearestAfter(ordered, values, i)
+			if haveBefore && haveAfter {
+				frac := float64(i-beforeIdx) / float64(afterIdx-beforeIdx)
+				out[ti] = before + frac*(after-before)
+			} else {
+				out[ti] = math.NaN()
+			}
+		default:
+			c, err := strconv.ParseFloat(string(fillMode), 64)
+			if err != nil {
+				return nil, fmt.Errorf("unknown fill mode %q", fillMode)
+			}
+			out[ti] = c
+		}
+	}
+	return out, nil
+}
+
+// nearestBefore returns the nearest preceding bucket (by index) with a
+// value, along with its index, so "linear" fill can weight its
+// interpolation by distance across a run of several empty buckets.
+func nearestBefore(ordered []TimeInterval, values map[TimeInterval]float64, idx int) (float64, int, bool) {
+	for i := idx - 1; i >= 0; i-- {
+		if v, ok := values[ordered[i]]; ok {
+			return v, i, true
+		}
+	}
+	return math.NaN(), -1, false
+}
+
+func nearestAfter(ordered []TimeInterval, values map[TimeInterval]float64, idx int) (float64, int, bool) {
+	for i := idx + 1; i < len(ordered); i++ {
+		if v, ok := values[ordered[i]]; ok {
+			return v, i, true
+		}
+	}
+	return math.NaN(), -1, false
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReduceSeriesRowsServerAggregatablePassthrough(t *testing.T) {
+	agg, err := ParseAggregation("sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := reduceSeriesRows(agg, []RiakTSRow{{Value: 42}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 42 {
+		t.Errorf("got %v, want 42", v)
+	}
+}
+
+func TestReduceSeriesRowsServerAggregatableWrongRowCount(t *testing.T) {
+	agg, _ := ParseAggregation("sum")
+	if _, err := reduceSeriesRows(agg, []RiakTSRow{{Value: 1}, {Value: 2}}); err == nil {
+		t.Fatal("expected an error for a server-aggregatable query with more than one row")
+	}
+}
+
+func TestReduceSeriesRowsServerAggregatableEmptyRangeIsNaN(t *testing.T) {
+	agg, _ := ParseAggregation("mean")
+	v, err := reduceSeriesRows(agg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsNaN(v) {
+		t.Errorf("got %v, want NaN for a server-aggregatable query over an empty range", v)
+	}
+}
+
+func TestReduceSeriesRowsClientSide(t *testing.T) {
+	base := time.Unix(0, 0)
+	rows := []RiakTSRow{
+		{Time: base.Add(2 * time.Second), Value: 30},
+		{Time: base, Value: 10},
+		{Time: base.Add(time.Second), Value: 20},
+	}
+
+	cases := []struct {
+		label string
+		want  float64
+	}{
+		{"first", 10},
+		{"last", 30},
+		{"stddev", stddevValues([]float64{10, 20, 30})},
+		{"percentile_50", 20},
+	}
+
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			agg, err := ParseAggregation(c.label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := reduceSeriesRows(agg, rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("reduceSeriesRows(%s) = %v, want %v", c.label, got, c.want)
+			}
+		})
+	}
+}
+
+func TestQueryPlanWithServerAggregationExecute(t *testing.T) {
+	base := time.Unix(0, 0)
+	ti := NewTimeInterval(base, base.Add(time.Minute))
+	q := NewRiakTSQuery(Aggregation{Kind: AggregationSum, Label: "sum"}, "cpu", "host_0", base.UnixNano(), base.Add(time.Minute).UnixNano())
+
+	agg, _ := ParseAggregation("sum")
+	plan, err := NewQueryPlanWithServerAggregation(agg, map[TimeInterval][]RiakTSQuery{ti: {q}}, nil, FillNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := plan.Execute(func(RiakTSQuery) ([]RiakTSRow, error) {
+		return []RiakTSRow{{Value: 99}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[ti] != 99 {
+		t.Errorf("results[ti] = %v, want 99", results[ti])
+	}
+}
+
+func TestQueryPlanWithServerAggregationExecutePropagatesRunnerError(t *testing.T) {
+	base := time.Unix(0, 0)
+	ti := NewTimeInterval(base, base.Add(time.Minute))
+	q := NewRiakTSQuery(Aggregation{}, "cpu", "host_0", base.UnixNano(), base.Add(time.Minute).UnixNano())
+
+	agg, _ := ParseAggregation("count")
+	plan, err := NewQueryPlanWithServerAggregation(agg, map[TimeInterval][]RiakTSQuery{ti: {q}}, nil, FillNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantErr := errors.New("connection reset")
+	_, err = plan.Execute(func(RiakTSQuery) ([]RiakTSRow, error) {
+		return nil, wantErr
+	})
+	if err == nil {
+		t.Fatal("expected Execute to propagate the runner's error")
+	}
+}
+
+func TestQueryPlanWithServerAggregationExecuteFillsEmptyServerAggregateBucket(t *testing.T) {
+	base := time.Unix(0, 0)
+	populated := NewTimeInterval(base, base.Add(time.Minute))
+	empty := NewTimeInterval(base.Add(time.Minute), base.Add(2*time.Minute))
+	qPopulated := NewRiakTSQuery(Aggregation{Kind: AggregationMean, Label: "mean"}, "cpu", "host_0", base.UnixNano(), base.Add(time.Minute).UnixNano())
+	qEmpty := NewRiakTSQuery(Aggregation{Kind: AggregationMean, Label: "mean"}, "cpu", "host_0", base.Add(time.Minute).UnixNano(), base.Add(2*time.Minute).UnixNano())
+
+	agg, _ := ParseAggregation("mean")
+	buckets := map[TimeInterval][]RiakTSQuery{populated: {qPopulated}, empty: {qEmpty}}
+	plan, err := NewQueryPlanWithServerAggregation(agg, buckets, nil, FillPrevious)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := plan.Execute(func(q RiakTSQuery) ([]RiakTSRow, error) {
+		if q == qEmpty {
+			return nil, nil // Riak TS returns no rows for mean() over an empty range
+		}
+		return []RiakTSRow{{Value: 50}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[empty] != 50 {
+		t.Errorf("results[empty] = %v, want 50 (FillPrevious should carry the populated bucket forward)", results[empty])
+	}
+}
+
+func TestQueryPlanWithServerAggregationExecuteSpaceAggregation(t *testing.T) {
+	base := time.Unix(0, 0)
+	ti := NewTimeInterval(base, base.Add(time.Minute))
+	qHostA := NewRiakTSQuery(Aggregation{Kind: AggregationMean, Label: "mean"}, "cpu", "host_a", base.UnixNano(), base.Add(time.Minute).UnixNano())
+	qHostB := NewRiakTSQuery(Aggregation{Kind: AggregationMean, Label: "mean"}, "cpu", "host_b", base.UnixNano(), base.Add(time.Minute).UnixNano())
+
+	agg, _ := ParseAggregation("mean")
+	spaceAgg := SpaceAvg
+	plan, err := NewQueryPlanWithServerAggregation(agg, map[TimeInterval][]RiakTSQuery{ti: {qHostA, qHostB}}, &spaceAgg, FillNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[RiakTSQuery]float64{qHostA: 10, qHostB: 30}
+	results, err := plan.Execute(func(q RiakTSQuery) ([]RiakTSRow, error) {
+		return []RiakTSRow{{Value: values[q]}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[ti] != 20 {
+		t.Errorf("results[ti] = %v, want 20 (avg of host_a=10 and host_b=30)", results[ti])
+	}
+}
+
+func TestApplyFillModeLinearWeightsByDistanceAcrossGap(t *testing.T) {
+	base := time.Unix(0, 0)
+	buckets := []TimeInterval{
+		NewTimeInterval(base, base.Add(time.Minute)),
+		NewTimeInterval(base.Add(time.Minute), base.Add(2*time.Minute)),   // empty
+		NewTimeInterval(base.Add(2*time.Minute), base.Add(3*time.Minute)), // empty
+		NewTimeInterval(base.Add(3*time.Minute), base.Add(4*time.Minute)),
+	}
+	values := map[TimeInterval]float64{
+		buckets[0]: 10,
+		buckets[3]: 40,
+	}
+
+	out, err := applyFillMode(values, buckets, "linear")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out[buckets[1]] != 20 {
+		t.Errorf("first empty bucket = %v, want 20", out[buckets[1]])
+	}
+	if out[buckets[2]] != 30 {
+		t.Errorf("second empty bucket = %v, want 30", out[buckets[2]])
+	}
+}
+
+func TestQueryPlanWithoutServerAggregationExecutePropagatesShardError(t *testing.T) {
+	base := time.Unix(0, 0)
+	buckets := []TimeInterval{NewTimeInterval(base, base.Add(time.Minute))}
+	q := NewRiakTSQuery(Aggregation{}, "cpu", "host_0", base.UnixNano(), base.Add(time.Minute).UnixNano())
+	q.ShardKey = 7 // no pool is registered for this shard below
+
+	agg, _ := ParseAggregation("sum")
+	plan, err := NewQueryPlanWithoutServerAggregation(agg, time.Minute, buckets, []RiakTSQuery{q}, FillNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executor := NewShardExecutor(map[ShardKey]*ClientPool{}, 1)
+	if _, _, err := plan.Execute(executor); err == nil {
+		t.Fatal("expected Execute to propagate the shard executor's error")
+	}
+}
+
+func TestQueryPlanWithoutServerAggregationExecuteFillModes(t *testing.T) {
+	base := time.Unix(0, 0)
+	buckets := []TimeInterval{
+		NewTimeInterval(base, base.Add(time.Minute)),
+		NewTimeInterval(base.Add(time.Minute), base.Add(2*time.Minute)), // left empty
+		NewTimeInterval(base.Add(2*time.Minute), base.Add(3*time.Minute)),
+	}
+
+	rows := []RiakTSRow{
+		{Time: base, Value: 10},
+		{Time: base.Add(2 * time.Minute), Value: 30},
+	}
+	pool := NewClientPool(func(string) ([]RiakTSRow, error) { return rows, nil })
+	executor := NewShardExecutor(map[ShardKey]*ClientPool{0: pool}, 2)
+
+	agg, _ := ParseAggregation("sum")
+	q := NewRiakTSQuery(Aggregation{}, "cpu", "host_0", base.UnixNano(), base.Add(3*time.Minute).UnixNano())
+
+	cases := []struct {
+		mode FillMode
+		want float64
+		skip bool // true if the middle bucket is expected to be absent
+	}{
+		{FillNone, 0, true},
+		{FillNull, math.NaN(), false},
+		{FillPrevious, 10, false},
+		{"linear", 20, false},
+		{"5", 5, false},
+	}
+
+	for _, c := range cases {
+		t.Run(string(c.mode), func(t *testing.T) {
+			plan, err := NewQueryPlanWithoutServerAggregation(agg, time.Minute, buckets, []RiakTSQuery{q}, c.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, latencies, err := plan.Execute(executor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(latencies) != 1 {
+				t.Errorf("len(latencies) = %d, want 1", len(latencies))
+			}
+
+			middle := buckets[1]
+			got, ok := results[middle]
+			if c.skip {
+				if ok {
+					t.Errorf("expected bucket %v to be omitted under FillNone, got %v", middle, got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected bucket %v to be present", middle)
+			}
+			if math.IsNaN(c.want) {
+				if !math.IsNaN(got) {
+					t.Errorf("got %v, want NaN", got)
+				}
+				return
+			}
+			if got != c.want {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestClampToQueryBounds checks that clampToQueryBounds narrows a bucket
+// that extends past qStart/qEnd back to the query's own range, while
+// leaving a bucket boundary that already lands inside [qStart, qEnd] -
+// including exactly on qStart or qEnd - untouched.
+func TestClampToQueryBounds(t *testing.T) {
+	qStart := time.Unix(0, 0)
+	qEnd := qStart.Add(3 * time.Minute)
+
+	cases := []struct {
+		name        string
+		bucketStart time.Time
+		bucketEnd   time.Time
+		wantStart   time.Time
+		wantEnd     time.Time
+	}{
+		{
+			name:        "first bucket starts exactly at qStart",
+			bucketStart: qStart,
+			bucketEnd:   qStart.Add(time.Minute),
+			wantStart:   qStart,
+			wantEnd:     qStart.Add(time.Minute),
+		},
+		{
+			name:        "bucket starting before qStart is clamped forward",
+			bucketStart: qStart.Add(-30 * time.Second),
+			bucketEnd:   qStart.Add(time.Minute),
+			wantStart:   qStart,
+			wantEnd:     qStart.Add(time.Minute),
+		},
+		{
+			name:        "last bucket ends exactly at qEnd",
+			bucketStart: qEnd.Add(-time.Minute),
+			bucketEnd:   qEnd,
+			wantStart:   qEnd.Add(-time.Minute),
+			wantEnd:     qEnd,
+		},
+		{
+			name:        "bucket ending after qEnd is clamped backward",
+			bucketStart: qEnd.Add(-time.Minute),
+			bucketEnd:   qEnd.Add(30 * time.Second),
+			wantStart:   qEnd.Add(-time.Minute),
+			wantEnd:     qEnd,
+		},
+		{
+			name:        "interior bucket is untouched",
+			bucketStart: qStart.Add(time.Minute),
+			bucketEnd:   qStart.Add(2 * time.Minute),
+			wantStart:   qStart.Add(time.Minute),
+			wantEnd:     qStart.Add(2 * time.Minute),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gotStart, gotEnd := clampToQueryBounds(c.bucketStart, c.bucketEnd, qStart, qEnd)
+			if !gotStart.Equal(c.wantStart) {
+				t.Errorf("start = %s, want %s", gotStart, c.wantStart)
+			}
+			if !gotEnd.Equal(c.wantEnd) {
+				t.Errorf("end = %s, want %s", gotEnd, c.wantEnd)
+			}
+		})
+	}
+}
+
+func TestParseAggregationPercentile(t *testing.T) {
+	agg, err := ParseAggregation("percentile_95")
+	if err != nil {
+		t.Fatalf("ParseAggregation returned error: %s", err)
+	}
+	if agg.Kind != AggregationPercentile {
+		t.Errorf("Kind = %v, want AggregationPercentile", agg.Kind)
+	}
+	if agg.Percentile != 95 {
+		t.Errorf("Percentile = %v, want 95", agg.Percentile)
+	}
+	if agg.ServerAggregatable() {
+		t.Error("percentile aggregation must not be server-aggregatable")
+	}
+}
+
+func TestParseAggregationUnknown(t *testing.T) {
+	if _, err := ParseAggregation("bogus"); err == nil {
+		t.Fatal("expected an error for an unknown aggregation label, got nil")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// ShardKey identifies which Riak TS cluster node (and thus which
+// connection pool) a query should be routed to. It is derived from the
+// series' table and row name so that all queries for the same series
+// always land on the same shard, mirroring InfluxDB's distributed query
+// mode.
+type ShardKey uint64
+
+// shardKeyFor derives the ShardKey for a series from its table and row
+// name.
+func shardKeyFor(tableName, rowName string) ShardKey {
+	h := fnv.New64a()
+	h.Write([]byte(tableName))
+	h.Write([]byte("/"))
+	h.Write([]byte(rowName))
+	return ShardKey(h.Sum64())
+}
+
+// ShardResult is the outcome of executing a single RiakTSQuery against its
+// assigned shard.
+type ShardResult struct {
+	ShardKey ShardKey
+	Rows     []RiakTSRow
+	Latency  time.Duration
+	Err      error
+}
+
+// ShardExecutor runs RiakTSQueries concurrently across a fixed-size worker
+// pool, routing each query to the connection pool for its ShardKey, and
+// streams results to a merging reducer as they complete rather than
+// waiting for every query to finish.
+type ShardExecutor struct {
+	pools       map[ShardKey]*ClientPool
+	workerCount int
+}
+
+// ClientPool is a pool of connections to a single Riak TS cluster node.
+// ShardExecutor routes every query for a given ShardKey to the ClientPool
+// that owns it, so that queries against the same node reuse connections.
+type ClientPool struct {
+	run func(queryString string) ([]RiakTSRow, error)
+}
+
+// NewClientPool builds a ClientPool that executes queries via run, e.g. a
+// function backed by the Riak TS Go client's own query method.
+func NewClientPool(run func(queryString string) ([]RiakTSRow, error)) *ClientPool {
+	return &ClientPool{run: run}
+}
+
+// Query runs queryString against this pool's Riak TS node and returns its
+// raw rows.
+func (p *ClientPool) Query(queryString string) ([]RiakTSRow, error) {
+	return p.run(queryString)
+}
+
+// NewShardExecutor builds a ShardExecutor that fans queries out across
+// workerCount concurrent workers. pools maps each ShardKey to the
+// connection pool that owns it.
+func NewShardExecutor(pools map[ShardKey]*ClientPool, workerCount int) *ShardExecutor {
+	return &ShardExecutor{pools: pools, workerCount: workerCount}
+}
+
+// Execute runs queries concurrently over the worker pool and calls reduce
+// with each ShardResult as it completes. It blocks until every query has
+// been executed.
+func (e *ShardExecutor) Execute(queries []RiakTSQuery, reduce func(ShardResult)) {
+	in := make(chan RiakTSQuery)
+	out := make(chan ShardResult)
+
+	var workers sync.WaitGroup
+	workers.Add(e.workerCount)
+	for i := 0; i < e.workerCount; i++ {
+		go func() {
+			defer workers.Done()
+			for q := range in {
+				out <- e.executeOne(q)
+			}
+		}()
+	}
+
+	go func() {
+		for _, q := range queries {
+			in <- q
+		}
+		close(in)
+	}()
+
+	go func() {
+		workers.Wait()
+		close(out)
+	}()
+
+	for res := range out {
+		reduce(res)
+	}
+}
+
+// executeOne runs a single RiakTSQuery against the connection pool for its
+// shard, recording the query's end-to-end latency for the benchmark
+// harness.
+func (e *ShardExecutor) executeOne(q RiakTSQuery) ShardResult {
+	start := time.Now()
+
+	pool, ok := e.pools[q.ShardKey]
+	if !ok {
+		return ShardResult{ShardKey: q.ShardKey, Err: fmt.Errorf("no connection pool registered for shard %d", q.ShardKey)}
+	}
+
+	rows, err := pool.Query(q.QueryString)
+	return ShardResult{
+		ShardKey: q.ShardKey,
+		Rows:     rows,
+		Latency:  time.Since(start),
+		Err:      err,
+	}
+}
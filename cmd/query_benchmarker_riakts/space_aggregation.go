@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// SpaceAggregationKind enumerates the outer-stage aggregations supported by
+// a two-stage temporal-then-spatial aggregation: an inner per-series
+// temporal aggregation (named by HLQuery.AggregationType) followed by an
+// outer aggregation across series within the same time bucket.
+type SpaceAggregationKind int
+
+const (
+	SpaceSum SpaceAggregationKind = iota
+	SpaceAvg
+	SpaceMin
+	SpaceMax
+	SpaceCount
+)
+
+// ParseSpaceAggregation parses a space-aggregation label, e.g. "avg".
+func ParseSpaceAggregation(label string) (SpaceAggregationKind, error) {
+	switch label {
+	case "sum":
+		return SpaceSum, nil
+	case "avg", "mean":
+		return SpaceAvg, nil
+	case "min":
+		return SpaceMin, nil
+	case "max":
+		return SpaceMax, nil
+	case "count":
+		return SpaceCount, nil
+	default:
+		return 0, fmt.Errorf("unknown space aggregation type %q", label)
+	}
+}
+
+// Reduce combines the per-series values of a single time bucket into one
+// value. NaNs are filtered out before combining, so a bucket where every
+// series produced NaN (e.g. an empty series) reduces to NaN rather than to
+// a misleading 0.
+func (k SpaceAggregationKind) Reduce(values []float64) float64 {
+	filtered := make([]float64, 0, len(values))
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			filtered = append(filtered, v)
+		}
+	}
+	if len(filtered) == 0 {
+		return math.NaN()
+	}
+
+	switch k {
+	case SpaceSum:
+		var sum float64
+		for _, v := range filtered {
+			sum += v
+		}
+		return sum
+	case SpaceAvg:
+		var sum float64
+		for _, v := range filtered {
+			sum += v
+		}
+		return sum / float64(len(filtered))
+	case SpaceMin:
+		min := filtered[0]
+		for _, v := range filtered[1:] {
+			if v < min {
+				min = v
+			}
+		}
+		return min
+	case SpaceMax:
+		max := filtered[0]
+		for _, v := range filtered[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	case SpaceCount:
+		return float64(len(filtered))
+	default:
+		panic(fmt.Sprintf("Reduce called with unknown SpaceAggregationKind %d", k))
+	}
+}
+
+// SpaceAggregatedResult is a single post-reduction data point: one value
+// per time bucket, after combining every series' per-bucket result with a
+// SpaceAggregationKind.
+type SpaceAggregatedResult struct {
+	TimeInterval
+	Value float64
+}
+
+// ReduceBucketsBySpace groups perSeriesResults by TimeInterval and applies
+// kind across the series present in each bucket. This is the outer stage
+// of a two-stage temporal-then-spatial aggregation plan, run after the
+// inner per-series RiakTSQueries have already produced one value per
+// series per bucket.
+func ReduceBucketsBySpace(perSeriesResults []RiakTSResult, kind SpaceAggregationKind) []SpaceAggregatedResult {
+	byBucket := map[TimeInterval][]float64{}
+	for _, r := range perSeriesResults {
+		byBucket[r.TimeInterval] = append(byBucket[r.TimeInterval], r.Value)
+	}
+
+	out := make([]SpaceAggregatedResult, 0, len(byBucket))
+	for ti, values := range byBucket {
+		out = append(out, SpaceAggregatedResult{TimeInterval: ti, Value: kind.Reduce(values)})
+	}
+	return out
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSpaceAggregationKindReduce(t *testing.T) {
+	cases := []struct {
+		name   string
+		kind   SpaceAggregationKind
+		values []float64
+		want   float64
+	}{
+		{"sum", SpaceSum, []float64{1, 2, 3}, 6},
+		{"avg", SpaceAvg, []float64{1, 2, 3}, 2},
+		{"min", SpaceMin, []float64{3, 1, 2}, 1},
+		{"max", SpaceMax, []float64{3, 1, 2}, 3},
+		{"count", SpaceCount, []float64{3, 1, 2}, 3},
+		{"avg filters NaN", SpaceAvg, []float64{1, math.NaN(), 3}, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := c.kind.Reduce(c.values)
+			if got != c.want {
+				t.Errorf("Reduce(%v) = %v, want %v", c.values, got, c.want)
+			}
+		})
+	}
+}
+
+func TestSpaceAggregationKindReduceAllNaNIsNaN(t *testing.T) {
+	got := SpaceAvg.Reduce([]float64{math.NaN(), math.NaN()})
+	if !math.IsNaN(got) {
+		t.Errorf("Reduce of all-NaN values = %v, want NaN", got)
+	}
+}
+
+func TestParseSpaceAggregationUnknown(t *testing.T) {
+	if _, err := ParseSpaceAggregation("bogus"); err == nil {
+		t.Fatal("expected an error for an unknown space aggregation label, got nil")
+	}
+}
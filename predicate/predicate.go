@@ -0,0 +1,162 @@
+// Package predicate lowers an InfluxQL-flavored WHERE predicate string into
+// the plain time range / group-by-duration / tag-set shape that benchmark
+// clients like HLQuery need, so that bulk query generators can emit one
+// human-readable query string that every backend's client shares instead of
+// each backend re-encoding its own query struct.
+package predicate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Result is the lowered form of a predicate string.
+type Result struct {
+	TimeStart       time.Time
+	TimeEnd         time.Time
+	GroupByDuration time.Duration
+	TagSets         [][]string // semantically, each subgroup is OR'ed and they are all AND'ed together
+}
+
+var groupByRe = regexp.MustCompile(`(?i)\s*GROUP BY time\(([^)]+)\)\s*$`)
+
+var comparisonOps = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// Parse lowers an InfluxQL-flavored predicate, e.g.
+//
+//	time >= '2016-01-01T00:00:00Z' AND time < '2016-01-02T00:00:00Z' AND (host = 'a' OR host = 'b') AND region = 'us-west' GROUP BY time(1m)
+//
+// into a Result. now is substituted for any now() time value, mirroring the
+// role influxql.NowValuer plays during influxql.Reduce.
+func Parse(pred string, now time.Time) (*Result, error) {
+	clause := strings.TrimSpace(pred)
+
+	res := &Result{}
+	if m := groupByRe.FindStringSubmatch(clause); m != nil {
+		d, err := time.ParseDuration(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("predicate: invalid GROUP BY time() duration %q: %s", m[1], err)
+		}
+		res.GroupByDuration = d
+		clause = clause[:len(clause)-len(m[0])]
+	}
+
+	haveStart, haveEnd := false, false
+	for _, term := range splitTopLevelAnd(clause) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		if strings.HasPrefix(term, "(") && strings.HasSuffix(term, ")") {
+			orTags, err := parseOrGroup(term[1 : len(term)-1])
+			if err != nil {
+				return nil, err
+			}
+			res.TagSets = append(res.TagSets, orTags)
+			continue
+		}
+
+		op, lhs, rhs, err := splitComparison(term)
+		if err != nil {
+			return nil, err
+		}
+
+		if lhs != "time" {
+			if op != "=" {
+				return nil, fmt.Errorf("predicate: unsupported tag operator %q in %q", op, term)
+			}
+			res.TagSets = append(res.TagSets, []string{fmt.Sprintf("%s=%s", lhs, rhs)})
+			continue
+		}
+
+		t, err := parseTimeValue(rhs, now)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case ">=", ">":
+			res.TimeStart = t
+			haveStart = true
+		case "<=", "<":
+			res.TimeEnd = t
+			haveEnd = true
+		default:
+			return nil, fmt.Errorf("predicate: unsupported time operator %q in %q", op, term)
+		}
+	}
+
+	if !haveStart || !haveEnd {
+		return nil, fmt.Errorf("predicate: %q must bound both a time start and a time end", pred)
+	}
+
+	return res, nil
+}
+
+// splitTopLevelAnd splits s on " AND ", ignoring ANDs nested inside a
+// parenthesized OR group.
+func splitTopLevelAnd(s string) []string {
+	upper := strings.ToUpper(s)
+	var terms []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth == 0 && strings.HasPrefix(upper[i:], " AND ") {
+			terms = append(terms, s[start:i])
+			i += len(" AND ") - 1
+			start = i + 1
+		}
+	}
+	return append(terms, s[start:])
+}
+
+// parseOrGroup parses the body of a parenthesized "a = 'x' OR a = 'y'"
+// group into a TagSets subgroup.
+func parseOrGroup(s string) ([]string, error) {
+	parts := strings.Split(s, " OR ")
+	tags := make([]string, 0, len(parts))
+	for _, p := range parts {
+		op, lhs, rhs, err := splitComparison(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		if op != "=" {
+			return nil, fmt.Errorf("predicate: unsupported tag operator %q in %q", op, p)
+		}
+		tags = append(tags, fmt.Sprintf("%s=%s", lhs, rhs))
+	}
+	return tags, nil
+}
+
+// splitComparison splits a single "lhs op rhs" term, stripping any quotes
+// around rhs.
+func splitComparison(term string) (op, lhs, rhs string, err error) {
+	for _, candidate := range comparisonOps {
+		if idx := strings.Index(term, candidate); idx >= 0 {
+			lhs = strings.TrimSpace(term[:idx])
+			rhs = strings.Trim(strings.TrimSpace(term[idx+len(candidate):]), `'"`)
+			return candidate, lhs, rhs, nil
+		}
+	}
+	return "", "", "", fmt.Errorf("predicate: could not parse comparison in %q", term)
+}
+
+// parseTimeValue parses a time.Time from an RFC3339 literal, or returns now
+// for a now() call.
+func parseTimeValue(s string, now time.Time) (time.Time, error) {
+	if strings.EqualFold(s, "now()") {
+		return now, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("predicate: invalid time value %q: %s", s, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,63 @@
+package predicate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2016, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name string
+		pred string
+		want Result
+	}{
+		{
+			name: "simple time range, no tags",
+			pred: "time >= '2016-01-01T00:00:00Z' AND time < '2016-01-02T00:00:00Z'",
+			want: Result{
+				TimeStart: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+				TimeEnd:   time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name: "now() substitution",
+			pred: "time >= '2016-01-01T00:00:00Z' AND time < now()",
+			want: Result{
+				TimeStart: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+				TimeEnd:   now,
+			},
+		},
+		{
+			name: "or group and plain tag, with group by",
+			pred: "time >= '2016-01-01T00:00:00Z' AND time < '2016-01-02T00:00:00Z' AND (host = 'a' OR host = 'b') AND region = 'us-west' GROUP BY time(1m)",
+			want: Result{
+				TimeStart:       time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+				TimeEnd:         time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC),
+				GroupByDuration: time.Minute,
+				TagSets:         [][]string{{"host=a", "host=b"}, {"region=us-west"}},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := Parse(c.pred, now)
+			if err != nil {
+				t.Fatalf("Parse(%q) returned error: %s", c.pred, err)
+			}
+			if !reflect.DeepEqual(*got, c.want) {
+				t.Errorf("Parse(%q) = %+v, want %+v", c.pred, *got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseMissingTimeBoundIsError(t *testing.T) {
+	_, err := Parse("host = 'a'", time.Now())
+	if err == nil {
+		t.Fatal("expected an error for a predicate with no time bounds, got nil")
+	}
+}